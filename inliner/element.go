@@ -0,0 +1,129 @@
+package inliner
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// Element represents a HTML element matched by one or more style rules
+type Element struct {
+	// Matched HTML node
+	elt *goquery.Selection
+
+	// Style rules matching this element, in stylesheet order
+	styleRules []*StyleRule
+
+	// decls holds the winning declarations once inline has run, so later
+	// passes (such as collectAnimationAndFontReferences) can scan what
+	// actually applies instead of every candidate rule
+	decls *declarationSet
+}
+
+// NewElement instanciates a new Element
+func NewElement(elt *goquery.Selection) *Element {
+	return &Element{elt: elt}
+}
+
+// addStyleRule appends a new style rule to this element
+func (element *Element) addStyleRule(rule *StyleRule) {
+	element.styleRules = append(element.styleRules, rule)
+}
+
+// inline merges the element's collected style rules and any pre-existing
+// inline style into a single `style` attribute. When cssToAttributes is
+// set, a fixed table of declarations is also copied onto their legacy
+// presentational HTML attribute, for email clients that strip `style`.
+// When rewriteURLs is set, url(...) tokens in the winning declarations
+// are resolved against base.
+func (element *Element) inline(cssToAttributes bool, rewriteURLs bool, base *url.URL) error {
+	decls := newDeclarationSet()
+
+	for _, rule := range element.styleRules {
+		for _, decl := range rule.Declarations {
+			decls.add(decl.Property, cascadeEntry{
+				value:       decl.Value,
+				important:   decl.Important,
+				specificity: rule.specificity,
+				order:       rule.order,
+			})
+		}
+	}
+
+	if style, exists := element.elt.Attr("style"); exists {
+		decls.mergeInline(style)
+	}
+
+	if cssToAttributes {
+		element.applyAttributeTranslation(decls)
+	}
+
+	if rewriteURLs && base != nil {
+		for _, property := range decls.order {
+			if cssURLProperties[property] {
+				value, _ := decls.get(property)
+				decls.overwrite(property, rewriteCSSURLs(value, base))
+			}
+		}
+	}
+
+	if style := decls.String(); style != "" {
+		element.elt.SetAttr("style", style)
+	}
+
+	element.decls = decls
+
+	return nil
+}
+
+// cssToAttribute maps a CSS property to its legacy HTML attribute
+// equivalent, restricted to the tags that still honor it in legacy email
+// clients
+type cssToAttribute struct {
+	property  string
+	attribute string
+	tags      map[string]bool
+}
+
+func tagSet(tags ...string) map[string]bool {
+	set := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		set[tag] = true
+	}
+	return set
+}
+
+var cssToAttributeTable = []cssToAttribute{
+	{"background-color", "bgcolor", tagSet("body", "table", "td", "tr", "th")},
+	{"text-align", "align", tagSet("div", "p", "table", "td", "tr", "th")},
+	{"vertical-align", "valign", tagSet("table", "td", "tr", "th")},
+	{"width", "width", tagSet("table", "td", "th", "img")},
+	{"height", "height", tagSet("table", "td", "th", "img")},
+	{"border-width", "border", tagSet("table", "img")},
+}
+
+// applyAttributeTranslation copies declarations from cssToAttributeTable
+// onto their HTML attribute equivalent, skipping tags not in the
+// allow-list and attributes the element already carries
+func (element *Element) applyAttributeTranslation(decls *declarationSet) {
+	tag := goquery.NodeName(element.elt)
+
+	for _, mapping := range cssToAttributeTable {
+		if !mapping.tags[tag] {
+			continue
+		}
+
+		value, exists := decls.get(mapping.property)
+		if !exists {
+			continue
+		}
+
+		if _, exists := element.elt.Attr(mapping.attribute); exists {
+			continue
+		}
+
+		value = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "px"))
+		element.elt.SetAttr(mapping.attribute, value)
+	}
+}
@@ -0,0 +1,108 @@
+package inliner
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/czlhs/douceur/css"
+	"github.com/czlhs/douceur/parser"
+)
+
+// maxImportDepth bounds how deep nested @import chains are followed, to
+// protect against pathological or cyclic stylesheets
+const maxImportDepth = 5
+
+// resolveImports walks a parsed stylesheet and replaces every `@import`
+// at-rule with the rules of the stylesheet it points to, fetched relative
+// to inliner.base. Imports are resolved recursively, up to
+// maxImportDepth, with a visited set (keyed by absolute URL) to break
+// cycles. An unreachable or unparsable import is logged and dropped
+// rather than failing the whole document.
+func (inliner *Inliner) resolveImports(stylesheet *css.Stylesheet) {
+	stylesheet.Rules = inliner.expandImports(stylesheet.Rules, make(map[string]bool), 0)
+}
+
+func (inliner *Inliner) expandImports(rules []*css.Rule, visited map[string]bool, depth int) []*css.Rule {
+	var result []*css.Rule
+
+	for _, rule := range rules {
+		if rule.Kind != css.AtRule || atRuleName(rule) != "import" {
+			result = append(result, rule)
+			continue
+		}
+
+		if depth >= maxImportDepth {
+			continue
+		}
+
+		importURL, media := parseImportPrelude(rule.Prelude)
+		if importURL == "" {
+			continue
+		}
+
+		absURL := toAbsoluteURI(importURL, inliner.base)
+		if visited[absURL] {
+			continue
+		}
+		visited[absURL] = true
+
+		body, err := inliner.loader.Load(absURL)
+		if err != nil {
+			fmt.Printf("douceur/inliner: skipping unreachable @import %s: %v\n", absURL, err)
+			continue
+		}
+
+		imported, err := parser.Parse(body)
+		if err != nil {
+			fmt.Printf("douceur/inliner: skipping unparsable @import %s: %v\n", absURL, err)
+			continue
+		}
+
+		importedRules := inliner.expandImports(imported.Rules, visited, depth+1)
+
+		// honor the media-query suffix, if any, by wrapping the spliced
+		// rules in an @media block so they stay conditional
+		if media != "" {
+			importedRules = []*css.Rule{{
+				Kind:    css.AtRule,
+				Name:    "media",
+				Prelude: media,
+				Rules:   importedRules,
+			}}
+		}
+
+		result = append(result, importedRules...)
+	}
+
+	return result
+}
+
+// parseImportPrelude splits an `@import` prelude such as
+// `url("foo.css") screen and (min-width: 480px)` into the referenced URL
+// and the optional trailing media query
+func parseImportPrelude(prelude string) (importURL string, media string) {
+	prelude = strings.TrimSpace(prelude)
+
+	var rest string
+	switch {
+	case strings.HasPrefix(prelude, "url("):
+		end := strings.Index(prelude, ")")
+		if end == -1 {
+			return "", ""
+		}
+		importURL = strings.Trim(prelude[4:end], `"' `)
+		rest = prelude[end+1:]
+	case strings.HasPrefix(prelude, `"`), strings.HasPrefix(prelude, "'"):
+		quote := prelude[0]
+		end := strings.IndexByte(prelude[1:], quote)
+		if end == -1 {
+			return "", ""
+		}
+		importURL = prelude[1 : end+1]
+		rest = prelude[end+2:]
+	default:
+		return "", ""
+	}
+
+	return importURL, strings.TrimSpace(rest)
+}
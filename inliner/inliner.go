@@ -4,9 +4,9 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"net/url"
 	"path"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -14,6 +14,7 @@ import (
 	"github.com/czlhs/douceur/css"
 	"github.com/czlhs/douceur/parser"
 	"golang.org/x/net/html"
+	"golang.org/x/sync/errgroup"
 )
 
 const (
@@ -45,9 +46,17 @@ type Inliner struct {
 	// CSS rules that are not inlinable but that must be inserted in output document
 	rawRules []fmt.Stringer
 
+	// @font-face and @keyframes rules, kept aside until resolveDeferredRules
+	// decides whether anything inlined actually references them
+	deferredRules []*css.Rule
+
 	// current element marker value
 	eltMarker int
 
+	// position of the next qualified rule in stylesheet source order,
+	// used to break cascade ties between rules of equal specificity
+	ruleOrder int
+
 	// fetch external stylesheets, false default not fetch
 	fetchExternal bool
 
@@ -56,6 +65,25 @@ type Inliner struct {
 
 	// base for parse relative path
 	base *url.URL
+
+	// translate a fixed set of CSS declarations into legacy HTML
+	// presentational attributes, for email clients that strip `style`
+	cssToAttributes bool
+
+	// loader fetches external and @import'ed stylesheets; shared by both
+	// so they get the same caching and concurrency behavior
+	loader StylesheetLoader
+
+	// maxConcurrency bounds how many stylesheets are fetched at once
+	maxConcurrency int
+
+	// drop @media/@supports blocks from the output <style> once their
+	// qualified rules have been inlined, instead of preserving them
+	stripMediaQueries bool
+
+	// resolve relative url(...) and src/href/background references
+	// against base once inlining is done
+	rewriteURLs bool
 }
 
 // InlineOption Inline option parameter
@@ -66,6 +94,31 @@ type InlineOption struct {
 	SourceURL string
 	// Proxy when fetch external css file, we can use squid to accelate by cache.
 	Proxy string
+	// CSSToAttributes, whether to also translate inlined declarations such
+	// as background-color or text-align into their legacy HTML attribute
+	// equivalent (bgcolor, align, ...), for email clients that ignore
+	// inline style
+	CSSToAttributes bool
+	// Loader, custom StylesheetLoader used to fetch external and
+	// @import'ed stylesheets. Takes precedence over BaseDir and Proxy.
+	Loader StylesheetLoader
+	// BaseDir, when set and Loader is nil, stylesheets are loaded from
+	// this local docroot instead of over HTTP
+	BaseDir string
+	// MaxConcurrency bounds how many stylesheets are fetched at once,
+	// defaults to 4
+	MaxConcurrency int
+	// StripMediaQueries, whether @media/@supports blocks are dropped from
+	// the output <style> once their qualified rules have been inlined,
+	// instead of being preserved (re-wrapped in their original at-rule)
+	// so the responsive override still applies. Leave unset for the
+	// common case of a client that does evaluate them; set it only when
+	// targeting a static renderer that never will.
+	StripMediaQueries bool
+	// RewriteURLs, whether to resolve relative url(...) tokens in CSS
+	// declarations, and src/href/background HTML attributes, against
+	// SourceURL once inlining is done. Requires SourceURL.
+	RewriteURLs bool
 }
 
 // NewInlinerFromReader instanciates a new Inliner
@@ -128,6 +181,15 @@ func (inliner *Inliner) Inline(option *InlineOption) (*goquery.Document, error)
 		return nil, err
 	}
 
+	// keep @font-face/@keyframes only if something inlined references them
+	inliner.resolveDeferredRules()
+
+	// resolve relative URLs left in raw CSS and HTML attributes
+	if inliner.rewriteURLs && inliner.base != nil {
+		inliner.rewriteRawDeclarationURLs()
+		inliner.rewriteAttributeURLs()
+	}
+
 	// insert raw stylesheet
 	inliner.insertRawStylesheet()
 
@@ -145,7 +207,9 @@ func (inliner *Inliner) parseHTML() error {
 	inliner.doc = doc
 
 	if inliner.fetchExternal {
-		inliner.fetchExternalStyle()
+		if err := inliner.fetchExternalStyle(); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -161,6 +225,9 @@ func (inliner *Inliner) parseStylesheets() error {
 			fmt.Println(s.Text())
 			return false
 		}
+		if inliner.fetchExternal {
+			inliner.resolveImports(stylesheet)
+		}
 		inliner.stylesheets = append(inliner.stylesheets, stylesheet)
 		// removes parsed stylesheet
 		s.Remove()
@@ -173,22 +240,176 @@ func (inliner *Inliner) parseStylesheets() error {
 // Collects HTML elements matching parsed stylesheets, and thus collect used style rules
 func (inliner *Inliner) collectElementsAndRules() {
 	for _, stylesheet := range inliner.stylesheets {
-		for _, rule := range stylesheet.Rules {
-			if rule.Kind == css.QualifiedRule {
-				// Let's go!
-				inliner.handleQualifiedRule(rule)
-			} else {
-				// Keep it 'as is'
+		inliner.collectRules(stylesheet.Rules)
+	}
+}
+
+// atRuleName returns an at-rule's name without its leading "@", so
+// comparisons work whether the underlying css package stores "media" or
+// "@media"
+func atRuleName(rule *css.Rule) string {
+	return strings.TrimPrefix(rule.Name, "@")
+}
+
+// collectRules inlines qualified rules and recurses into @media/@supports
+// blocks so selectors nested inside them get a chance to match too;
+// @font-face and @keyframes are set aside for resolveDeferredRules to
+// decide on once every declaration has been collected
+func (inliner *Inliner) collectRules(rules []*css.Rule) {
+	for _, rule := range rules {
+		name := atRuleName(rule)
+		switch {
+		case rule.Kind == css.QualifiedRule:
+			inliner.handleQualifiedRule(rule)
+		case rule.Kind == css.AtRule && (name == "media" || name == "supports"):
+			inliner.handleConditionalRule(rule)
+		case rule.Kind == css.AtRule && (name == "font-face" || name == "keyframes"):
+			inliner.deferredRules = append(inliner.deferredRules, rule)
+		default:
+			// Keep it 'as is'
+			inliner.rawRules = append(inliner.rawRules, rule)
+		}
+	}
+}
+
+// handleConditionalRule inlines the qualified rules nested inside an
+// @media/@supports block as usual. Unless StripMediaQueries is set, the
+// block itself (still wrapped in its original at-rule) is also kept in
+// rawRules, so the conditional override still applies to clients that
+// honor the remaining <style> element.
+func (inliner *Inliner) handleConditionalRule(rule *css.Rule) {
+	if !inliner.stripMediaQueries {
+		inliner.rawRules = append(inliner.rawRules, rule)
+	}
+
+	inliner.collectRules(rule.Rules)
+}
+
+// resolveDeferredRules keeps only the @font-face/@keyframes rules whose
+// name or font-family is actually referenced by a winning declaration
+func (inliner *Inliner) resolveDeferredRules() {
+	if len(inliner.deferredRules) == 0 {
+		return
+	}
+
+	animations, fonts := inliner.collectAnimationAndFontReferences()
+
+	for _, rule := range inliner.deferredRules {
+		switch atRuleName(rule) {
+		case "keyframes":
+			if animations[rule.Prelude] {
 				inliner.rawRules = append(inliner.rawRules, rule)
 			}
+		case "font-face":
+			for _, decl := range rule.Declarations {
+				if decl.Property == "font-family" && fonts[trimQuotes(decl.Value)] {
+					inliner.rawRules = append(inliner.rawRules, rule)
+					break
+				}
+			}
+		}
+	}
+}
+
+// collectAnimationAndFontReferences scans every winning declaration (the
+// ones an element actually ends up inlined with, plus any rule kept raw
+// because its selector couldn't be inlined) for animation/animation-name
+// and font-family/font tokens
+func (inliner *Inliner) collectAnimationAndFontReferences() (animations map[string]bool, fonts map[string]bool) {
+	animations = make(map[string]bool)
+	fonts = make(map[string]bool)
+
+	record := func(property, value string) {
+		switch property {
+		case "animation", "animation-name":
+			for _, token := range strings.Fields(value) {
+				animations[token] = true
+			}
+		case "font-family":
+			for _, token := range strings.Split(value, ",") {
+				if family := trimQuotes(strings.TrimSpace(token)); family != "" {
+					fonts[family] = true
+				}
+			}
+		case "font":
+			for _, family := range extractFontShorthandFamilies(value) {
+				fonts[family] = true
+			}
+		}
+	}
+
+	for _, element := range inliner.elements {
+		if element.decls == nil {
+			continue
+		}
+		for property, entry := range element.decls.entries {
+			record(property, entry.value)
+		}
+	}
+	for _, rawRule := range inliner.rawRules {
+		if styleRule, ok := rawRule.(*StyleRule); ok {
+			for _, decl := range styleRule.Declarations {
+				record(decl.Property, decl.Value)
+			}
+		}
+	}
+
+	return animations, fonts
+}
+
+func trimQuotes(value string) string {
+	return strings.Trim(value, `"'`)
+}
+
+// fontShorthandFamilyPattern pulls a quoted family name out of a `font`
+// shorthand's first comma-separated segment, e.g. `12px "Font A"`
+var fontShorthandFamilyPattern = regexp.MustCompile(`["']([^"']*)["']`)
+
+// extractFontShorthandFamilies returns the font-family names referenced by
+// a `font` shorthand value. The first segment also carries size/line-height/
+// weight/style, so a quoted family there is pulled out with
+// fontShorthandFamilyPattern; an unquoted first segment (a keyword like
+// `inherit`, or a generic family) carries no family reference. Every
+// subsequent segment is a plain family name.
+func extractFontShorthandFamilies(value string) []string {
+	var families []string
+
+	segments := strings.Split(value, ",")
+	for i, segment := range segments {
+		segment = strings.TrimSpace(segment)
+		if segment == "" {
+			continue
+		}
+		if i == 0 {
+			if match := fontShorthandFamilyPattern.FindStringSubmatch(segment); match != nil {
+				families = append(families, match[1])
+			}
+			continue
+		}
+		if family := trimQuotes(segment); family != "" {
+			families = append(families, family)
 		}
 	}
+
+	return families
+}
+
+// nextRuleOrder returns the next position in stylesheet source order
+func (inliner *Inliner) nextRuleOrder() int {
+	order := inliner.ruleOrder
+	inliner.ruleOrder++
+	return order
 }
 
 // Handles parsed qualified rule
 func (inliner *Inliner) handleQualifiedRule(rule *css.Rule) {
 	for _, selector := range rule.Selectors {
 		if Inlinable(selector.Value) {
+			// every element matched by this selector shares the same
+			// position in stylesheet source order
+			styleRule := NewStyleRule(selector.Value, rule.Declarations)
+			styleRule.order = inliner.nextRuleOrder()
+
 			inliner.doc.Find(selector.Value).Each(func(i int, s *goquery.Selection) {
 				// get marker
 				eltMarker, exists := s.Attr(eltMarkerAttr)
@@ -203,7 +424,7 @@ func (inliner *Inliner) handleQualifiedRule(rule *css.Rule) {
 				}
 
 				// add style rule for element
-				inliner.elements[eltMarker].addStyleRule(NewStyleRule(selector.Value, rule.Declarations))
+				inliner.elements[eltMarker].addStyleRule(styleRule)
 			})
 		} else {
 			// Keep it 'as is'
@@ -219,7 +440,7 @@ func (inliner *Inliner) inlineStyleRules() error {
 		element.elt.RemoveAttr(eltMarkerAttr)
 
 		// inline element
-		err := element.inline()
+		err := element.inline(inliner.cssToAttributes, inliner.rewriteURLs, inliner.base)
 		if err != nil {
 			return err
 		}
@@ -269,41 +490,52 @@ func (inliner *Inliner) insertRawStylesheet() {
 	}
 }
 
-func (inliner *Inliner) fetchExternalStyle() (err error) {
-	proxyURL, err := url.Parse(inliner.proxy)
-	if err != nil {
-		return
-	}
-	httpClinet := http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyURL(proxyURL),
-		},
-	}
-
-	inliner.doc.Find("link").EachWithBreak(func(_ int, s *goquery.Selection) bool {
+// fetchExternalStyle fetches every <link rel="stylesheet"> via
+// inliner.loader, concurrently and bounded by inliner.maxConcurrency, and
+// replaces each <link> with the fetched CSS wrapped in a <style> element.
+// A link that fails to load is logged and left untouched rather than
+// aborting the whole Inline() call.
+func (inliner *Inliner) fetchExternalStyle() error {
+	var links []*goquery.Selection
+	inliner.doc.Find("link").Each(func(_ int, s *goquery.Selection) {
 		if rel, ok := s.Attr("rel"); ok && rel == "stylesheet" {
-			cssURL, ok := s.Attr("href")
-			if !ok || cssURL == "" {
-				return true
-			}
-			cssURL = toAbsoluteURI(cssURL, inliner.base)
-			resp, errTmp := httpClinet.Get(cssURL)
-			if err != nil {
-				err = errTmp
-				return false
+			if href, ok := s.Attr("href"); ok && href != "" {
+				links = append(links, s)
 			}
-			defer resp.Body.Close()
-			style, errTmp := ioutil.ReadAll(resp.Body)
+		}
+	})
+
+	styles := make([]string, len(links))
+	loaded := make([]bool, len(links))
+
+	group := new(errgroup.Group)
+	group.SetLimit(inliner.maxConcurrency)
+
+	for i, link := range links {
+		i, link := i, link
+		group.Go(func() error {
+			href, _ := link.Attr("href")
+			cssURL := toAbsoluteURI(href, inliner.base)
+			style, err := inliner.loader.Load(cssURL)
 			if err != nil {
-				err = errTmp
-				return false
+				fmt.Printf("douceur/inliner: skipping unreachable stylesheet %s: %v\n", cssURL, err)
+				return nil
 			}
-			s.ReplaceWithHtml(fmt.Sprintf(`<style type="text/css"> %s </style>`, style))
-			return true
+			styles[i] = style
+			loaded[i] = true
+			return nil
+		})
+	}
+
+	group.Wait()
+
+	for i, link := range links {
+		if loaded[i] {
+			link.ReplaceWithHtml(fmt.Sprintf(`<style type="text/css"> %s </style>`, styles[i]))
 		}
-		return true
-	})
-	return
+	}
+
+	return nil
 }
 
 // Generates HTML
@@ -355,7 +587,7 @@ func (inliner *Inliner) resolveOption(option *InlineOption) error {
 	}
 
 	inliner.fetchExternal = option.FetchExternal
-	if option.FetchExternal && option.SourceURL != "" {
+	if (option.FetchExternal || option.RewriteURLs) && option.SourceURL != "" {
 		base, err := url.Parse(option.SourceURL)
 		if err != nil {
 			return err
@@ -365,6 +597,35 @@ func (inliner *Inliner) resolveOption(option *InlineOption) error {
 	if option.Proxy != "" {
 		inliner.proxy = option.Proxy
 	}
+	inliner.cssToAttributes = option.CSSToAttributes
+	inliner.stripMediaQueries = option.StripMediaQueries
+	inliner.rewriteURLs = option.RewriteURLs
+
+	inliner.maxConcurrency = option.MaxConcurrency
+	if inliner.maxConcurrency <= 0 {
+		inliner.maxConcurrency = defaultMaxConcurrency
+	}
+
+	if option.FetchExternal {
+		loader, err := inliner.buildLoader(option)
+		if err != nil {
+			return err
+		}
+		inliner.loader = newCachedLoader(loader, defaultCacheSize, defaultCacheTTL)
+	}
 
 	return nil
 }
+
+// buildLoader picks the StylesheetLoader to use per option: an explicit
+// Loader wins, then a filesystem docroot, and otherwise the default HTTP
+// loader (honoring Proxy)
+func (inliner *Inliner) buildLoader(option *InlineOption) (StylesheetLoader, error) {
+	if option.Loader != nil {
+		return option.Loader, nil
+	}
+	if option.BaseDir != "" {
+		return NewFilesystemLoader(option.BaseDir), nil
+	}
+	return newHTTPLoader(option.Proxy)
+}
@@ -0,0 +1,196 @@
+package inliner
+
+import (
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultCacheSize and defaultCacheTTL bound the LRU cache every
+// StylesheetLoader built by resolveOption is wrapped with
+const (
+	defaultCacheSize      = 64
+	defaultCacheTTL       = 5 * time.Minute
+	defaultMaxConcurrency = 4
+)
+
+// StylesheetLoader fetches the raw CSS text of an external stylesheet,
+// identified by its absolute URL. It is shared by `<link>` fetching and
+// `@import` resolution, so both benefit from the same caching and
+// concurrency behavior.
+type StylesheetLoader interface {
+	Load(rawURL string) (string, error)
+}
+
+// httpLoader is the default StylesheetLoader, fetching stylesheets over
+// HTTP(S), optionally through a proxy
+type httpLoader struct {
+	client *http.Client
+}
+
+// newHTTPLoader instanciates a new httpLoader, routed through proxy when set
+func newHTTPLoader(proxy string) (*httpLoader, error) {
+	if proxy == "" {
+		return &httpLoader{client: http.DefaultClient}, nil
+	}
+
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	return &httpLoader{
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy: http.ProxyURL(proxyURL),
+			},
+		},
+	}, nil
+}
+
+// Load implements StylesheetLoader
+func (loader *httpLoader) Load(rawURL string) (string, error) {
+	resp, err := loader.client.Get(rawURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return string(body), nil
+}
+
+// FilesystemLoader loads stylesheets from a local docroot, so
+// `<link href="/css/main.css">` resolves against files on disk instead
+// of requiring a web server
+type FilesystemLoader struct {
+	// BaseDir is the docroot every URL path is resolved against
+	BaseDir string
+}
+
+// NewFilesystemLoader instanciates a new FilesystemLoader rooted at baseDir
+func NewFilesystemLoader(baseDir string) *FilesystemLoader {
+	return &FilesystemLoader{BaseDir: baseDir}
+}
+
+// Load implements StylesheetLoader
+func (loader *FilesystemLoader) Load(rawURL string) (string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	joined := filepath.Join(loader.BaseDir, filepath.FromSlash(parsed.Path))
+
+	rel, err := filepath.Rel(loader.BaseDir, joined)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("inliner: %q escapes base dir %q", rawURL, loader.BaseDir)
+	}
+
+	body, err := ioutil.ReadFile(joined)
+	if err != nil {
+		return "", err
+	}
+
+	return string(body), nil
+}
+
+// cacheEntry is one LRU-tracked response
+type cacheEntry struct {
+	url       string
+	body      string
+	expiresAt time.Time
+}
+
+// cachedLoader decorates a StylesheetLoader with an LRU cache keyed by
+// absolute URL, so a repeated `<link>`/`@import` reference to a
+// stylesheet that is already cached doesn't hit the underlying loader
+// again. Concurrent loads of a URL that isn't cached yet each call the
+// underlying loader; they are not merged.
+type cachedLoader struct {
+	mu       sync.Mutex
+	next     StylesheetLoader
+	maxSize  int
+	ttl      time.Duration
+	entries  map[string]*list.Element
+	eviction *list.List
+}
+
+// newCachedLoader wraps next with an LRU cache of at most maxSize entries,
+// each valid for ttl (zero means "never expires")
+func newCachedLoader(next StylesheetLoader, maxSize int, ttl time.Duration) *cachedLoader {
+	return &cachedLoader{
+		next:     next,
+		maxSize:  maxSize,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		eviction: list.New(),
+	}
+}
+
+// Load implements StylesheetLoader
+func (loader *cachedLoader) Load(rawURL string) (string, error) {
+	if body, ok := loader.get(rawURL); ok {
+		return body, nil
+	}
+
+	body, err := loader.next.Load(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	loader.put(rawURL, body)
+	return body, nil
+}
+
+func (loader *cachedLoader) get(rawURL string) (string, bool) {
+	loader.mu.Lock()
+	defer loader.mu.Unlock()
+
+	elt, ok := loader.entries[rawURL]
+	if !ok {
+		return "", false
+	}
+
+	entry := elt.Value.(*cacheEntry)
+	if loader.ttl > 0 && time.Now().After(entry.expiresAt) {
+		loader.removeLocked(elt)
+		return "", false
+	}
+
+	loader.eviction.MoveToFront(elt)
+	return entry.body, true
+}
+
+func (loader *cachedLoader) put(rawURL, body string) {
+	loader.mu.Lock()
+	defer loader.mu.Unlock()
+
+	entry := &cacheEntry{url: rawURL, body: body}
+	if loader.ttl > 0 {
+		entry.expiresAt = time.Now().Add(loader.ttl)
+	}
+	loader.entries[rawURL] = loader.eviction.PushFront(entry)
+
+	if loader.maxSize > 0 {
+		for loader.eviction.Len() > loader.maxSize {
+			loader.removeLocked(loader.eviction.Back())
+		}
+	}
+}
+
+func (loader *cachedLoader) removeLocked(elt *list.Element) {
+	entry := elt.Value.(*cacheEntry)
+	delete(loader.entries, entry.url)
+	loader.eviction.Remove(elt)
+}
@@ -0,0 +1,204 @@
+package inliner
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/czlhs/douceur/css"
+)
+
+// specificity is a CSS selector specificity, expressed as a 4-tuple
+// (inline style, id selectors, class/attribute/pseudo-class selectors,
+// element and pseudo-element selectors). The leading component is never
+// set by computeSpecificity - it exists solely so inlineSpecificity can
+// outrank every selector, no matter how many ids it carries, per
+// https://www.w3.org/TR/selectors/#specificity
+type specificity [4]int
+
+// inlineSpecificity is the specificity attributed to a pre-existing
+// inline `style` attribute: it outranks any selector specificity, per
+// https://www.w3.org/TR/CSS2/cascade.html#specificity
+var inlineSpecificity = specificity{1, 0, 0, 0}
+
+var (
+	idSelectorPattern          = regexp.MustCompile(`#[\w-]+`)
+	pseudoElementPattern       = regexp.MustCompile(`::[\w-]+`)
+	classSelectorPattern       = regexp.MustCompile(`\.[\w-]+`)
+	attrSelectorPattern        = regexp.MustCompile(`\[[^\]]*\]`)
+	pseudoClassSelectorPattern = regexp.MustCompile(`:[\w-]+(\([^)]*\))?`)
+	elementSelectorPattern     = regexp.MustCompile(`[a-zA-Z][\w-]*`)
+)
+
+// computeSpecificity computes the specificity of a (possibly compound,
+// possibly combinator-joined) CSS selector. Each pattern is matched
+// against what's left of the selector after the patterns applied before
+// it have consumed their matches (ids first, pseudo-elements before
+// pseudo-classes, elements last), so e.g. the id in "#foo" isn't also
+// counted as an element.
+func computeSpecificity(selector string) specificity {
+	var spec specificity
+	working := selector
+
+	consume := func(pattern *regexp.Regexp, weight int) {
+		for _, match := range pattern.FindAllString(working, -1) {
+			spec[weight]++
+			working = strings.Replace(working, match, "", 1)
+		}
+	}
+
+	consume(idSelectorPattern, 1)
+	consume(pseudoElementPattern, 3)
+	consume(classSelectorPattern, 2)
+	consume(attrSelectorPattern, 2)
+	consume(pseudoClassSelectorPattern, 2)
+	consume(elementSelectorPattern, 3)
+
+	return spec
+}
+
+// StyleRule is a CSS rule matched against the HTML document, ready to be
+// inlined onto its matching elements
+type StyleRule struct {
+	// CSS selector this rule was declared with
+	Selector string
+
+	// Declarations carried by this rule
+	Declarations []*css.Declaration
+
+	// specificity of Selector, used to resolve the cascade
+	specificity specificity
+
+	// position of this rule in stylesheet source order, used to break
+	// specificity ties between rules of equal weight
+	order int
+}
+
+// NewStyleRule instanciates a new StyleRule
+func NewStyleRule(selector string, declarations []*css.Declaration) *StyleRule {
+	return &StyleRule{
+		Selector:     selector,
+		Declarations: declarations,
+		specificity:  computeSpecificity(selector),
+	}
+}
+
+// String returns the CSS text representation of the rule, used when the
+// rule cannot be inlined and must be kept in a <style> element
+func (rule *StyleRule) String() string {
+	var decls []string
+	for _, decl := range rule.Declarations {
+		decls = append(decls, decl.String())
+	}
+	return fmt.Sprintf("%s {\n  %s\n}", rule.Selector, strings.Join(decls, "\n  "))
+}
+
+// cascadeEntry is a candidate value for a single CSS property, ranked by
+// (important, specificity, source order) so the winning declaration can
+// be picked when several rules target the same property of one element
+type cascadeEntry struct {
+	value       string
+	important   bool
+	specificity specificity
+	order       int
+}
+
+// wins reports whether candidate should replace current as the winner of
+// the cascade for their shared property
+func (candidate cascadeEntry) wins(current cascadeEntry) bool {
+	if candidate.important != current.important {
+		return candidate.important
+	}
+	if candidate.specificity != current.specificity {
+		return current.specificity.less(candidate.specificity)
+	}
+	return candidate.order >= current.order
+}
+
+func (spec specificity) less(other specificity) bool {
+	for i := range spec {
+		if spec[i] != other[i] {
+			return spec[i] < other[i]
+		}
+	}
+	return false
+}
+
+// declarationSet keeps, for each CSS property, the declaration that wins
+// the cascade, while preserving first-seen ordering for output
+type declarationSet struct {
+	order   []string
+	entries map[string]cascadeEntry
+}
+
+func newDeclarationSet() *declarationSet {
+	return &declarationSet{entries: make(map[string]cascadeEntry)}
+}
+
+// add considers a candidate declaration for property, keeping it only if
+// it wins the cascade against whatever is currently recorded; a losing
+// declaration is dropped rather than concatenated
+func (set *declarationSet) add(property string, candidate cascadeEntry) {
+	current, exists := set.entries[property]
+	if !exists {
+		set.order = append(set.order, property)
+		set.entries[property] = candidate
+		return
+	}
+	if candidate.wins(current) {
+		set.entries[property] = candidate
+	}
+}
+
+// get returns the winning value recorded for property, if any
+func (set *declarationSet) get(property string) (string, bool) {
+	entry, exists := set.entries[property]
+	return entry.value, exists
+}
+
+// overwrite replaces the value of an already-recorded property without
+// affecting its cascade ranking
+func (set *declarationSet) overwrite(property, value string) {
+	entry := set.entries[property]
+	entry.value = value
+	set.entries[property] = entry
+}
+
+// mergeInline folds a pre-existing `style` attribute into the set, at
+// inlineSpecificity; a declaration carrying !important is also ranked as
+// important
+func (set *declarationSet) mergeInline(style string) {
+	for _, decl := range strings.Split(style, ";") {
+		decl = strings.TrimSpace(decl)
+		if decl == "" {
+			continue
+		}
+		parts := strings.SplitN(decl, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		property := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+
+		important := false
+		if strings.HasSuffix(value, "!important") {
+			important = true
+			value = strings.TrimSpace(strings.TrimSuffix(value, "!important"))
+		}
+
+		set.add(property, cascadeEntry{
+			value:       value,
+			important:   important,
+			specificity: inlineSpecificity,
+		})
+	}
+}
+
+// String renders the declaration set as a `style` attribute value
+func (set *declarationSet) String() string {
+	var parts []string
+	for _, property := range set.order {
+		parts = append(parts, fmt.Sprintf("%s: %s;", property, set.entries[property].value))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,128 @@
+package inliner
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/czlhs/douceur/css"
+)
+
+// urlTokenPattern matches a CSS url(...) token in double-quoted,
+// single-quoted or unquoted form. Go's RE2 engine has no backreferences,
+// so each quoting style gets its own capture group instead of a shared
+// `\1`; exactly one of the three is non-empty for any match.
+var urlTokenPattern = regexp.MustCompile(`url\(\s*(?:"([^"]*)"|'([^']*)'|([^'")\s]+))\s*\)`)
+
+// cssURLProperties lists the declarations that may carry a url(...)
+// token worth rewriting, plus @font-face's `src`
+var cssURLProperties = map[string]bool{
+	"background":       true,
+	"background-image": true,
+	"list-style-image": true,
+	"cursor":           true,
+	"src":              true,
+}
+
+// urlAttributes lists the tag/attribute pairs whose value is a URL that
+// RewriteURLs should resolve against the document's base
+var urlAttributes = []struct {
+	selector  string
+	attribute string
+}{
+	{"img", "src"},
+	{"source", "src"},
+	{"video", "src"},
+	{"audio", "src"},
+	{"a", "href"},
+	{"table", "background"},
+	{"td", "background"},
+}
+
+// skipURLRewrite reports whether rawURL shouldn't be touched by
+// RewriteURLs: a fragment-only value (`#anchor`) has nothing to resolve,
+// and any URL that already carries a scheme (data:, cid:, mailto:, tel:,
+// http(s):, ...) is either non-hierarchical or already absolute
+func skipURLRewrite(rawURL string) bool {
+	if rawURL == "" || strings.HasPrefix(rawURL, "#") {
+		return true
+	}
+
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return true
+	}
+
+	return parsed.IsAbs()
+}
+
+// rewriteCSSURLs rewrites every url(...) token found in a declaration
+// value against base, preserving the original quoting style
+func rewriteCSSURLs(value string, base *url.URL) string {
+	return urlTokenPattern.ReplaceAllStringFunc(value, func(token string) string {
+		match := urlTokenPattern.FindStringSubmatch(token)
+
+		quote := ""
+		rawURL := match[3]
+		switch {
+		case match[1] != "":
+			quote, rawURL = `"`, match[1]
+		case match[2] != "":
+			quote, rawURL = "'", match[2]
+		}
+
+		if rawURL == "" || skipURLRewrite(rawURL) {
+			return token
+		}
+		return "url(" + quote + toAbsoluteURI(rawURL, base) + quote + ")"
+	})
+}
+
+// rewriteDeclarationURLs rewrites the url(...) tokens of every
+// URL-bearing declaration in decls, in place
+func rewriteDeclarationURLs(decls []*css.Declaration, base *url.URL) {
+	for _, decl := range decls {
+		if cssURLProperties[decl.Property] {
+			decl.Value = rewriteCSSURLs(decl.Value, base)
+		}
+	}
+}
+
+// rewriteRuleURLs rewrites the declarations of rule and, recursively, of
+// any rule nested inside it (an @media/@supports block)
+func rewriteRuleURLs(rule *css.Rule, base *url.URL) {
+	rewriteDeclarationURLs(rule.Declarations, base)
+	for _, embedded := range rule.Rules {
+		rewriteRuleURLs(embedded, base)
+	}
+}
+
+// rewriteRawDeclarationURLs rewrites the URLs carried by every rule kept
+// verbatim in rawRules (raw selectors, @media/@supports blocks,
+// surviving @font-face rules)
+func (inliner *Inliner) rewriteRawDeclarationURLs() {
+	for _, rawRule := range inliner.rawRules {
+		switch rule := rawRule.(type) {
+		case *StyleRule:
+			rewriteDeclarationURLs(rule.Declarations, inliner.base)
+		case *css.Rule:
+			rewriteRuleURLs(rule, inliner.base)
+		}
+	}
+}
+
+// rewriteAttributeURLs rewrites src/href/background attributes that
+// reference an asset relative to the document, so the emailed-out HTML
+// doesn't carry paths that have no meaning outside the original page
+func (inliner *Inliner) rewriteAttributeURLs() {
+	for _, target := range urlAttributes {
+		inliner.doc.Find(target.selector).Each(func(_ int, s *goquery.Selection) {
+			value, exists := s.Attr(target.attribute)
+			if !exists || value == "" || skipURLRewrite(value) {
+				return
+			}
+			s.SetAttr(target.attribute, toAbsoluteURI(value, inliner.base))
+		})
+	}
+}